@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// ----- AnkiConnect 経由で直接インポートするモード -----
+//
+// TSV + collection.media への書き出しを挟まず、変換済みの各行を AnkiConnect の
+// JSON-RPC 呼び出しとして実行中の Anki へ流し込む。同じ ZIP を再実行しても
+// 重複ノートが増えないよう、行ごとに決定的なタグを付けて findNotes で存在確認する。
+
+const ankiConnectVersion = 6
+
+type acRequest struct {
+	Action  string `json:"action"`
+	Version int    `json:"version"`
+	Params  any    `json:"params,omitempty"`
+}
+
+type acResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *string         `json:"error"`
+}
+
+// ankiConnectCall は AnkiConnect の単一アクションを呼び出す。
+func ankiConnectCall(url, action string, params any, result any) error {
+	body, err := json.Marshal(acRequest{Action: action, Version: ankiConnectVersion, Params: params})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("anki-connect %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	var ar acResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+		return fmt.Errorf("anki-connect %s: decode response: %w", action, err)
+	}
+	if ar.Error != nil {
+		return fmt.Errorf("anki-connect %s: %s", action, *ar.Error)
+	}
+	if result != nil && len(ar.Result) > 0 {
+		if err := json.Unmarshal(ar.Result, result); err != nil {
+			return fmt.Errorf("anki-connect %s: decode result: %w", action, err)
+		}
+	}
+	return nil
+}
+
+// processZipAnkiConnect は item.csv を変換しつつ、media/ の各ファイルを
+// storeMediaFile で登録し、各行を addNote/updateNoteFields で Anki に直接流し込む。
+func processZipAnkiConnect(zipPath, color, ankiConnectURL string, rules *Rules) error {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var target *zip.File
+	var fallback *zip.File
+	for _, f := range zr.File {
+		base := strings.ToLower(path.Base(f.Name))
+		switch base {
+		case "item.csv", "items.csv":
+			target = f
+		default:
+			if strings.HasSuffix(base, ".csv") && fallback == nil {
+				fallback = f
+			}
+		}
+	}
+	if target == nil {
+		target = fallback
+	}
+	if target == nil {
+		return fmt.Errorf("item.csv not found in %s", zipPath)
+	}
+
+	stored, renames, err := storeZipMediaFiles(zr.File, ankiConnectURL)
+	if err != nil {
+		return fmt.Errorf("store media from %s: %w", zipPath, err)
+	}
+	if stored > 0 {
+		fmt.Printf("anki-connect: stored %d media file(s)\n", stored)
+	}
+
+	rc, err := target.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	deckName := baseNameNoExt(zipPath)
+	rows, err := readNoteRows(rc, color, rules)
+	if err != nil {
+		return err
+	}
+	if len(renames) > 0 {
+		for i, row := range rows {
+			rows[i].front = rewriteMediaRefs(row.front, renames)
+			rows[i].back = rewriteMediaRefs(row.back, renames)
+		}
+	}
+
+	if err := ensureDeck(ankiConnectURL, deckName); err != nil {
+		return fmt.Errorf("create deck %q: %w", deckName, err)
+	}
+	if err := ensureModel(ankiConnectURL); err != nil {
+		return fmt.Errorf("create model %q: %w", apkgModelName, err)
+	}
+
+	added, updated := 0, 0
+	for _, row := range rows {
+		tag := rowTag(zipPath, row)
+		did, err := findNoteByTag(ankiConnectURL, tag)
+		if err != nil {
+			return err
+		}
+		fields := map[string]string{"Front": row.front, "Back": row.back}
+		if did == 0 {
+			if err := ankiConnectCall(ankiConnectURL, "addNote", map[string]any{
+				"note": map[string]any{
+					"deckName":  deckName,
+					"modelName": apkgModelName,
+					"fields":    fields,
+					"tags":      []string{tag},
+				},
+			}, nil); err != nil {
+				return err
+			}
+			added++
+		} else {
+			if err := ankiConnectCall(ankiConnectURL, "updateNoteFields", map[string]any{
+				"note": map[string]any{"id": did, "fields": fields},
+			}, nil); err != nil {
+				return err
+			}
+			updated++
+		}
+	}
+	fmt.Printf("anki-connect: added=%d updated=%d -> deck %q\n", added, updated, deckName)
+	return nil
+}
+
+// ensureDeck は deckName のデッキを作る（createDeck は既存デッキ名に対しては
+// エラーにならず、既存IDを返すだけなので呼びっぱなしでよい）。
+func ensureDeck(ankiConnectURL, deckName string) error {
+	return ankiConnectCall(ankiConnectURL, "createDeck", map[string]any{"deck": deckName}, nil)
+}
+
+// ensureModel は apkgModelName のノートタイプ（Front/Back の2フィールド、
+// apkgCardTemplate と同じ1テンプレート）が無ければ作る。createModel は
+// 既存モデル名に対してエラーを返すため、先に modelNames で存在確認する。
+func ensureModel(ankiConnectURL string) error {
+	var names []string
+	if err := ankiConnectCall(ankiConnectURL, "modelNames", nil, &names); err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == apkgModelName {
+			return nil
+		}
+	}
+	return ankiConnectCall(ankiConnectURL, "createModel", map[string]any{
+		"modelName":     apkgModelName,
+		"inOrderFields": []string{"Front", "Back"},
+		"css":           apkgModelCSS,
+		"cardTemplates": []map[string]any{
+			{"Name": "Card 1", "Front": "{{Front}}", "Back": apkgCardTemplate},
+		},
+	}, nil)
+}
+
+// storeZipMediaFiles は zip 内の media/ 配下を base64 化して storeMediaFile に渡す。
+// copyZipMediaFiles 同様、拡張子と中身の食い違いを sniffMismatch/correctedExt で
+// 補正し、この ZIP 内でコンテンツハッシュが一致するファイルは1回だけ送って
+// 残りはスキップする（重複判定は呼び出しごとで、別の ZIP で送った分は覚えていない
+// ため、同じ素材を積んだ別 ZIP では改めて送る）。renames は呼び出し側が rewriteMediaRefs で
+// row.front/row.back の参照を書き換えるための 旧名->新名 対応表。
+func storeZipMediaFiles(files []*zip.File, ankiConnectURL string) (stored int, renames map[string]string, err error) {
+	renames = make(map[string]string)
+	seen := make(map[string]string) // contentHash -> 送信済みファイル名
+
+	for _, f := range files {
+		name := strings.TrimLeft(f.Name, "/\\")
+		parts := strings.Split(name, "/")
+		if len(parts) == 0 || !strings.EqualFold(parts[0], "media") {
+			continue
+		}
+		rel := strings.Join(parts[1:], "/")
+		if rel == "" || f.FileInfo().IsDir() {
+			continue
+		}
+		origName := path.Base(rel)
+
+		rc, openErr := f.Open()
+		if openErr != nil {
+			return stored, renames, openErr
+		}
+		data, readErr := io.ReadAll(rc)
+		rc.Close()
+		if readErr != nil {
+			return stored, renames, readErr
+		}
+
+		finalName := origName
+		if sniffMismatch(finalName, data) {
+			if fixed := correctedExt(data); fixed != "" {
+				finalName = strings.TrimSuffix(finalName, filepath.Ext(finalName)) + fixed
+			}
+		}
+
+		hash := contentHash(data)
+		if dup, ok := seen[hash]; ok {
+			if dup != origName {
+				renames[origName] = dup
+			}
+			continue
+		}
+		seen[hash] = finalName
+		if finalName != origName {
+			renames[origName] = finalName
+		}
+
+		if err := ankiConnectCall(ankiConnectURL, "storeMediaFile", map[string]any{
+			"filename": finalName,
+			"data":     base64.StdEncoding.EncodeToString(data),
+		}, nil); err != nil {
+			return stored, renames, err
+		}
+		stored++
+	}
+	return stored, renames, nil
+}
+
+// rowTag は同じ ZIP を再実行しても同じ行には同じタグが振られるようにする決定的なタグ。
+// Anki のタグは空白を含められず（保存時に複数タグへ分割されてしまう）、検索クエリも
+// 空白区切りでトークン化されるため、ZIP ファイル名由来の部分は sanitizeTag で
+// 空白等をアンダースコアへ置き換えてから埋め込む。
+func rowTag(zipPath string, row noteRow) string {
+	sum := sha1.Sum([]byte(row.front + "\x1f" + row.back + "\x1f" + row.audio))
+	return fmt.Sprintf("anki-formater:%s:%x", sanitizeTag(baseNameNoExt(zipPath)), sum[:8])
+}
+
+// sanitizeTag は Anki のタグとして安全な文字列にするため、空白を含む
+// 区切り文字・制御文字をアンダースコアへ置き換える。
+func sanitizeTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// findNoteByTag は指定タグを持つノートを探し、あれば最初の1件のIDを返す（なければ0）。
+// タグ自体は既に sanitizeTag 済みだが、クエリとして渡す際に Anki の検索構文で
+// 特別扱いされる文字（空白等）が解釈されないよう %q で引用符とエスケープを行う。
+func findNoteByTag(ankiConnectURL, tag string) (int64, error) {
+	var ids []int64
+	if err := ankiConnectCall(ankiConnectURL, "findNotes", map[string]any{
+		"query": fmt.Sprintf("tag:%q", tag),
+	}, &ids); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return ids[0], nil
+}
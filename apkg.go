@@ -0,0 +1,388 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// Anki の最小ノートタイプ：Front/Backの2フィールド、1テンプレート。
+// 音声は transform() の insertAudio が既に Front へ [sound:...] を
+// 埋め込んでいるので、ここでは別フィールドとして重複させない。
+const apkgModelName = "anki-formater"
+
+const apkgCardTemplate = `{{Front}}
+<hr id="answer">
+{{Back}}`
+
+const apkgModelCSS = `.card { font-family: arial; font-size: 20px; text-align: center; color: black; background-color: white; }`
+
+// noteRow は transform() 後の1レコード分のデータ。
+type noteRow struct {
+	front string
+	back  string
+	audio string
+}
+
+// processZipApkg は processZip の apkg 版：item.csv を変換し、media/ を
+// collection.media 相当へコピーする代わりに、1つの .apkg ファイルへまとめる。
+func processZipApkg(zipPath, outPath, color string, rules *Rules) error {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var target *zip.File
+	var fallback *zip.File
+	var mediaFiles []*zip.File
+
+	for _, f := range zr.File {
+		base := strings.ToLower(path.Base(f.Name))
+		switch base {
+		case "item.csv", "items.csv":
+			target = f
+		default:
+			if strings.HasSuffix(base, ".csv") && fallback == nil {
+				fallback = f
+			}
+		}
+		name := strings.TrimLeft(f.Name, "/\\")
+		parts := strings.Split(name, "/")
+		if len(parts) >= 2 && strings.EqualFold(parts[0], "media") && !f.FileInfo().IsDir() {
+			mediaFiles = append(mediaFiles, f)
+		}
+	}
+	if target == nil {
+		target = fallback
+	}
+	if target == nil {
+		return fmt.Errorf("item.csv not found in %s", zipPath)
+	}
+
+	rc, err := target.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	rows, err := readNoteRows(rc, color, rules)
+	if err != nil {
+		return err
+	}
+
+	return writeApkg(outPath, rows, mediaFiles)
+}
+
+// dedupeMediaFiles は mediaFiles を読み込み、拡張子と中身の食い違いを
+// correctedExt で補正しつつ、同一コンテンツ（sha256 一致）のファイルは
+// 最初の1件だけを残す。collection.media 相当のコピー先を持たないため
+// hashExistingMedia は使わず、この ZIP 内での重複のみを畳む。
+// 返り値は書き出す順の (ファイル名, データ) と、補正/重複で名前が変わった
+// ファイルの 旧名->新名 対応表（rewriteMediaRefs に渡す）。
+func dedupeMediaFiles(mediaFiles []*zip.File) ([]string, map[string][]byte, map[string]string, error) {
+	var order []string
+	data := make(map[string][]byte)
+	renames := make(map[string]string)
+	seen := make(map[string]string) // contentHash -> 採用済みファイル名
+
+	for _, f := range mediaFiles {
+		rel := strings.TrimLeft(f.Name, "/\\")
+		parts := strings.SplitN(rel, "/", 2)
+		name := path.Base(rel)
+		if len(parts) == 2 {
+			name = path.Base(parts[1])
+		}
+
+		src, err := f.Open()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		raw, err := io.ReadAll(src)
+		src.Close()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		finalName := name
+		if sniffMismatch(finalName, raw) {
+			if fixed := correctedExt(raw); fixed != "" {
+				finalName = strings.TrimSuffix(finalName, filepath.Ext(finalName)) + fixed
+			}
+		}
+
+		hash := contentHash(raw)
+		if dup, ok := seen[hash]; ok {
+			if dup != name {
+				renames[name] = dup
+			}
+			continue
+		}
+		seen[hash] = finalName
+		if finalName != name {
+			renames[name] = finalName
+		}
+		order = append(order, finalName)
+		data[finalName] = raw
+	}
+	return order, data, renames, nil
+}
+
+// readNoteRows は TSV(item.csv) を transform() にかけ、apkg 用の行に変換する。
+func readNoteRows(r io.Reader, color string, rules *Rules) ([]noteRow, error) {
+	br := stripBOM(bufio.NewReader(r))
+	cr := csv.NewReader(br)
+	cr.Comma = '\t'
+	cr.LazyQuotes = true
+
+	var rows []noteRow
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) == 0 {
+			continue
+		}
+
+		htmlIn := rec[0]
+		sound := ""
+		if len(rec) >= 2 {
+			sound = strings.TrimSpace(rec[1])
+		}
+
+		htmlOut, ja := transform(htmlIn, sound, color, rules)
+		rows = append(rows, noteRow{front: htmlOut, back: ja, audio: sound})
+	}
+	return rows, nil
+}
+
+// writeApkg は notes/media から .apkg (ZIP: collection.anki2 + media manifest + 連番メディア) を作る。
+func writeApkg(outPath string, rows []noteRow, mediaFiles []*zip.File) error {
+	check(os.MkdirAll(filepath.Dir(outPath), 0o755))
+
+	order, media, renames, err := dedupeMediaFiles(mediaFiles)
+	if err != nil {
+		return err
+	}
+	if len(renames) > 0 {
+		for i, row := range rows {
+			rows[i].front = rewriteMediaRefs(row.front, renames)
+			rows[i].back = rewriteMediaRefs(row.back, renames)
+		}
+	}
+
+	dbPath, err := buildCollectionDB(rows)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dbPath)
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+
+	if err := addFileToZip(zw, "collection.anki2", dbPath); err != nil {
+		zw.Close()
+		return err
+	}
+
+	manifest := make(map[string]string, len(order))
+	for i, name := range order {
+		idx := strconv.Itoa(i)
+		manifest[idx] = name
+
+		w, err := zw.Create(idx)
+		if err != nil {
+			zw.Close()
+			return err
+		}
+		if _, err := w.Write(media[name]); err != nil {
+			zw.Close()
+			return err
+		}
+	}
+
+	mw, err := zw.Create("media")
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	if err := json.NewEncoder(mw).Encode(manifest); err != nil {
+		zw.Close()
+		return err
+	}
+
+	return zw.Close()
+}
+
+// buildCollectionDB は一時ファイルに collection.anki2 相当の SQLite DB を作り、そのパスを返す。
+func buildCollectionDB(rows []noteRow) (string, error) {
+	tmp, err := os.CreateTemp("", "anki-formater-*.anki2")
+	if err != nil {
+		return "", err
+	}
+	dbPath := tmp.Name()
+	tmp.Close()
+	os.Remove(dbPath) // sql.Open が新規作成する
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(apkgSchemaSQL); err != nil {
+		return dbPath, err
+	}
+
+	modelID := int64(1)
+	deckID := int64(1)
+	if _, err := db.Exec(`INSERT INTO col (id, crt, mod, scm, ver, dty, usn, ls, conf, models, decks, dconf, tags)
+		VALUES (1, 0, 0, 0, 11, 0, 0, 0, '{}', ?, ?, '{}', '{}')`,
+		modelsJSON(modelID), decksJSON(deckID)); err != nil {
+		return dbPath, err
+	}
+
+	for i, row := range rows {
+		noteID := int64(i + 1)
+		cardID := int64(i + 1)
+		flds := strings.Join([]string{row.front, row.back}, "\x1f")
+		if _, err := db.Exec(`INSERT INTO notes (id, guid, mid, mod, usn, tags, flds, sfld, csum, flags, data)
+			VALUES (?, ?, ?, 0, -1, '', ?, ?, 0, 0, '')`,
+			noteID, fmt.Sprintf("af-%d", noteID), modelID, flds, row.front); err != nil {
+			return dbPath, err
+		}
+		if _, err := db.Exec(`INSERT INTO cards (id, nid, did, ord, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data)
+			VALUES (?, ?, ?, 0, 0, -1, 0, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, '')`,
+			cardID, noteID, deckID, noteID); err != nil {
+			return dbPath, err
+		}
+	}
+
+	return dbPath, nil
+}
+
+func modelsJSON(modelID int64) string {
+	model := map[string]any{
+		"id":   modelID,
+		"name": apkgModelName,
+		"type": 0,
+		"flds": []map[string]any{
+			{"name": "Front", "ord": 0},
+			{"name": "Back", "ord": 1},
+		},
+		"tmpls": []map[string]any{
+			{"name": "Card 1", "ord": 0, "qfmt": "{{Front}}", "afmt": apkgCardTemplate},
+		},
+		"css": apkgModelCSS,
+	}
+	b, _ := json.Marshal(map[string]any{strconv.FormatInt(modelID, 10): model})
+	return string(b)
+}
+
+func decksJSON(deckID int64) string {
+	deck := map[string]any{
+		"id":   deckID,
+		"name": "anki-formater",
+	}
+	b, _ := json.Marshal(map[string]any{strconv.FormatInt(deckID, 10): deck})
+	return string(b)
+}
+
+func addFileToZip(zw *zip.Writer, name, srcPath string) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// apkgSchemaSQL は Anki の collection.anki2 が持つテーブルのうち、本ツールが
+// 書き出す範囲だけを定義した最小スキーマ。
+const apkgSchemaSQL = `
+CREATE TABLE col (
+	id integer primary key,
+	crt integer not null,
+	mod integer not null,
+	scm integer not null,
+	ver integer not null,
+	dty integer not null,
+	usn integer not null,
+	ls integer not null,
+	conf text not null,
+	models text not null,
+	decks text not null,
+	dconf text not null,
+	tags text not null
+);
+CREATE TABLE notes (
+	id integer primary key,
+	guid text not null,
+	mid integer not null,
+	mod integer not null,
+	usn integer not null,
+	tags text not null,
+	flds text not null,
+	sfld text not null,
+	csum integer not null,
+	flags integer not null,
+	data text not null
+);
+CREATE TABLE cards (
+	id integer primary key,
+	nid integer not null,
+	did integer not null,
+	ord integer not null,
+	mod integer not null,
+	usn integer not null,
+	type integer not null,
+	queue integer not null,
+	due integer not null,
+	ivl integer not null,
+	factor integer not null,
+	reps integer not null,
+	lapses integer not null,
+	left integer not null,
+	odue integer not null,
+	odid integer not null,
+	flags integer not null,
+	data text not null
+);
+CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null);
+CREATE TABLE revlog (
+	id integer primary key,
+	cid integer not null,
+	usn integer not null,
+	ease integer not null,
+	ivl integer not null,
+	lastIvl integer not null,
+	factor integer not null,
+	time integer not null,
+	type integer not null
+);
+`
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// transform は1枚のカードHTML(htmlIn)を Anki 向けに整形する。
+// 旧実装は ~8本の正規表現をHTML文字列へ繰り返し当てていたが、入れ子の
+// dc-translation や複数行スタイル、属性順序違いに弱かったため、DOM を
+// 1回だけ歩いて変換するパイプラインに置き換えている。
+//
+//  1. <style> サブツリーを削除
+//  2. 最初に見つかった dc-translation を ja として抽出（div直書きは削除、それ以外は残す）
+//  3. {{cN::front::back}} テキストノードを色付き <span> に書き換え、back を ja の保険にする
+//  4. dc-down / dc-gap の span を剥がす
+//  5. dc-card / dc-image に inline スタイルを付与
+//  6. 英文直下（最初の class="dc-line"）に音声を挿入
+func transform(h, sound, color string, rules *Rules) (string, string) {
+	root := parseFragment(h)
+
+	removeStyleNodes(root)
+
+	translationWord := classWord(rules.Translation.Selector)
+	ja, removed := extractDcLineTranslation(root, translationWord)
+	if !removed {
+		ja = findAnyTranslation(root, translationWord)
+	}
+
+	ja = applyClozeText(root, color, ja)
+
+	unwrapWords := make([]string, len(rules.Unwrap))
+	for i, u := range rules.Unwrap {
+		unwrapWords[i] = classWord(u.Selector)
+	}
+	unwrapSpans(root, unwrapWords...)
+
+	for _, d := range rules.Decorate {
+		decorateDiv(root, classWord(d.Selector), d.Style)
+	}
+	decorateImageDiv(root, classWord(rules.Image.Selector), rules.Image.Style)
+
+	insertAudio(root, sound)
+
+	out := renderFragment(root)
+	out = strings.ReplaceAll(out, "  ", " ")
+	return out, ja
+}
+
+var reCloze = regexp.MustCompile(`(?is)\{\{c\d+::(.*?)(?:::(.*?))?\}\}`)
+var reBgImage = regexp.MustCompile(`(?is)background-image\s*:\s*url\(([^)]+)\)`)
+
+// parseFragment は htmlIn を <body> の子要素群としてパースし、扱いやすい
+// 仮想ルートノードにぶら下げて返す。
+func parseFragment(h string) *html.Node {
+	bodyCtx := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(h), bodyCtx)
+	root := &html.Node{Type: html.DocumentNode}
+	if err != nil {
+		root.AppendChild(&html.Node{Type: html.TextNode, Data: h})
+		return root
+	}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+	return root
+}
+
+// renderFragment は仮想ルートの子要素を連結してHTML文字列に戻す。
+func renderFragment(root *html.Node) string {
+	return renderChildren(root)
+}
+
+// renderChildren は n の子要素だけを連結してHTML文字列に戻す。
+func renderChildren(n *html.Node) string {
+	var buf bytes.Buffer
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		_ = html.Render(&buf, c)
+	}
+	return buf.String()
+}
+
+// parseFragmentNodes は s を parseFragment と同じ文脈でパースし、
+// 仮想ルートにぶら下がったノード列をそのまま（親から外して）返す。
+func parseFragmentNodes(s string) []*html.Node {
+	root := parseFragment(s)
+	var nodes []*html.Node
+	for c := root.FirstChild; c != nil; {
+		next := c.NextSibling
+		root.RemoveChild(c)
+		nodes = append(nodes, c)
+		c = next
+	}
+	return nodes
+}
+
+// walk は n の子孫を深さ優先で訪問する。visit が true を返したノードは
+// その場で削除済みとみなし、子孫への再帰を行わない。
+func walk(n *html.Node, visit func(*html.Node) bool) {
+	c := n.FirstChild
+	for c != nil {
+		next := c.NextSibling
+		if !visit(c) {
+			walk(c, visit)
+		}
+		c = next
+	}
+}
+
+func removeStyleNodes(root *html.Node) {
+	walk(root, func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Style {
+			n.Parent.RemoveChild(n)
+			return true
+		}
+		return false
+	})
+}
+
+// classFields はノードの class 属性値を空白区切りのトークン列として返す。
+func classFields(n *html.Node) []string {
+	for _, a := range n.Attr {
+		if a.Key == "class" {
+			return strings.Fields(a.Val)
+		}
+	}
+	return nil
+}
+
+func classHas(n *html.Node, word string) bool {
+	for _, f := range classFields(n) {
+		if f == word {
+			return true
+		}
+	}
+	return false
+}
+
+func classHasAll(n *html.Node, words ...string) bool {
+	for _, w := range words {
+		if !classHas(n, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func getAttr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func setAttrs(n *html.Node, kv ...string) {
+	attrs := make([]html.Attribute, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		attrs = append(attrs, html.Attribute{Key: kv[i], Val: kv[i+1]})
+	}
+	n.Attr = attrs
+}
+
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var walkText func(*html.Node)
+	walkText = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walkText(c)
+		}
+	}
+	walkText(n)
+	return b.String()
+}
+
+// extractDcLineTranslation は class="dc-line dc-translation ..." な要素を探し、
+// 見つかればそのテキストをHTMLから削除した上で返す（後方互換のdiv直書き対応）。
+func extractDcLineTranslation(root *html.Node, translationWord string) (string, bool) {
+	var found *html.Node
+	walk(root, func(n *html.Node) bool {
+		if found == nil && n.Type == html.ElementNode && classHasAll(n, "dc-line", translationWord) {
+			found = n
+		}
+		return false
+	})
+	if found == nil {
+		return "", false
+	}
+	ja := strings.TrimSpace(textContent(found))
+	found.Parent.RemoveChild(found)
+	return ja, true
+}
+
+// findAnyTranslation は場所・タグを問わず最初に見つかった dc-translation の
+// テキストを返す（HTMLからは削除しない）。
+func findAnyTranslation(root *html.Node, translationWord string) string {
+	var found *html.Node
+	walk(root, func(n *html.Node) bool {
+		if found == nil && n.Type == html.ElementNode && classHas(n, translationWord) {
+			found = n
+		}
+		return false
+	})
+	if found == nil {
+		return ""
+	}
+	return strings.TrimSpace(textContent(found))
+}
+
+// applyClozeText は {{cN::front::back}} を含むテキストノードを front だけの
+// 色付き <span> に置き換える。back は ja がまだ空のときの保険として使う。
+//
+// front/back に <b> などのインライン要素が混ざっていると、パース時点で
+// {{c1::<b>foo</b>::bar}} が兄弟ノード列（テキスト/要素/テキスト）に
+// 分割されてしまい、1ノードだけを見る reCloze では二度とマッチしない。
+// そのケースは親の子要素をまとめて再シリアライズし、そこへ正規表現を
+// 当ててから front/back を再パースして組み直す。
+func applyClozeText(root *html.Node, color, ja string) string {
+	var process func(*html.Node)
+	process = func(n *html.Node) {
+		if nodeHasSplitCloze(n) {
+			back := rewriteClozeAcrossChildren(n, color)
+			if ja == "" && back != "" {
+				ja = back
+			}
+			return
+		}
+		c := n.FirstChild
+		for c != nil {
+			next := c.NextSibling
+			if c.Type == html.TextNode && reCloze.MatchString(c.Data) {
+				repl, back := clozeReplacementNodes(c.Data, color)
+				if ja == "" && back != "" {
+					ja = back
+				}
+				for _, rn := range repl {
+					n.InsertBefore(rn, c)
+				}
+				n.RemoveChild(c)
+			} else {
+				process(c)
+			}
+			c = next
+		}
+	}
+	process(root)
+	return ja
+}
+
+// nodeHasSplitCloze は n の子要素のどれか1つだけでは {{cN::...}} にマッチしないが、
+// 子要素をまとめてレンダリングすると初めてマッチする（＝マークアップを挟んで
+// 分割された cloze がある）かどうかを判定する。いずれかの子1つ（とその部分木）
+// だけで完結しているマッチはここでは扱わず、より深い階層の再帰に任せる。
+func nodeHasSplitCloze(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		var buf bytes.Buffer
+		_ = html.Render(&buf, c)
+		if reCloze.MatchString(buf.String()) {
+			return false
+		}
+	}
+	full := renderChildren(n)
+	return strings.Contains(full, "{{c") && reCloze.MatchString(full)
+}
+
+// rewriteClozeAcrossChildren は n の子要素をまとめてレンダリングした文字列に
+// reCloze を当て、front/back をHTMLとして再パースしたノード列で n の子要素を
+// 置き換える。
+func rewriteClozeAcrossChildren(n *html.Node, color string) string {
+	full := renderChildren(n)
+	nodes, back := clozeReplacementNodesHTML(full, color)
+	for n.FirstChild != nil {
+		n.RemoveChild(n.FirstChild)
+	}
+	for _, nn := range nodes {
+		n.AppendChild(nn)
+	}
+	return back
+}
+
+func clozeReplacementNodes(s, color string) ([]*html.Node, string) {
+	matches := reCloze.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return []*html.Node{{Type: html.TextNode, Data: s}}, ""
+	}
+
+	var nodes []*html.Node
+	ja := ""
+	last := 0
+	for _, m := range matches {
+		if m[0] > last {
+			nodes = append(nodes, &html.Node{Type: html.TextNode, Data: s[last:m[0]]})
+		}
+		front, back := "", ""
+		if m[2] >= 0 {
+			front = s[m[2]:m[3]]
+		}
+		if len(m) >= 6 && m[4] >= 0 {
+			back = s[m[4]:m[5]]
+		}
+		if ja == "" && strings.TrimSpace(back) != "" {
+			ja = strings.TrimSpace(back)
+		}
+		if plain := strings.TrimSpace(front); plain != "" {
+			span := &html.Node{Type: html.ElementNode, Data: "span", DataAtom: atom.Span}
+			setAttrs(span, "style", "color:"+color+";")
+			span.AppendChild(&html.Node{Type: html.TextNode, Data: plain})
+			nodes = append(nodes, span)
+		}
+		last = m[1]
+	}
+	if last < len(s) {
+		nodes = append(nodes, &html.Node{Type: html.TextNode, Data: s[last:]})
+	}
+	return nodes, ja
+}
+
+// clozeReplacementNodesHTML は clozeReplacementNodes のHTML対応版。front/back を
+// プレーンテキストではなくHTML断片としてパースし、マークアップを保ったまま
+// span で包む（front/back がタグをまたいで分割されていたケース用）。
+func clozeReplacementNodesHTML(s, color string) ([]*html.Node, string) {
+	matches := reCloze.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return parseFragmentNodes(s), ""
+	}
+
+	var nodes []*html.Node
+	ja := ""
+	last := 0
+	for _, m := range matches {
+		if m[0] > last {
+			nodes = append(nodes, parseFragmentNodes(s[last:m[0]])...)
+		}
+		front, back := "", ""
+		if m[2] >= 0 {
+			front = s[m[2]:m[3]]
+		}
+		if len(m) >= 6 && m[4] >= 0 {
+			back = s[m[4]:m[5]]
+		}
+		if ja == "" && strings.TrimSpace(back) != "" {
+			ja = strings.TrimSpace(back)
+		}
+		if plain := strings.TrimSpace(front); plain != "" {
+			span := &html.Node{Type: html.ElementNode, Data: "span", DataAtom: atom.Span}
+			setAttrs(span, "style", "color:"+color+";")
+			for _, fn := range parseFragmentNodes(front) {
+				span.AppendChild(fn)
+			}
+			nodes = append(nodes, span)
+		}
+		last = m[1]
+	}
+	if last < len(s) {
+		nodes = append(nodes, parseFragmentNodes(s[last:])...)
+	}
+	return nodes, ja
+}
+
+// unwrapSpans は classWords のいずれかを持つ要素を、その子要素で置き換える
+// （装飾用の span だけ剥がしてテキスト・子要素は残す）。
+func unwrapSpans(root *html.Node, classWords ...string) {
+	var process func(*html.Node)
+	process = func(n *html.Node) {
+		c := n.FirstChild
+		for c != nil {
+			next := c.NextSibling
+			process(c)
+			if c.Type == html.ElementNode && classHasAny(c, classWords...) {
+				gc := c.FirstChild
+				for gc != nil {
+					gcNext := gc.NextSibling
+					c.RemoveChild(gc)
+					n.InsertBefore(gc, c)
+					gc = gcNext
+				}
+				n.RemoveChild(c)
+			}
+			c = next
+		}
+	}
+	process(root)
+}
+
+func classHasAny(n *html.Node, words ...string) bool {
+	for _, w := range words {
+		if classHas(n, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// decorateDiv は classWord を持つ div から他の属性を落とし、渡された
+// inline スタイルだけを付与する（旧正規表現実装の dc-card 処理の挙動を踏襲）。
+func decorateDiv(root *html.Node, classWord, style string) {
+	walk(root, func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Div && classHas(n, classWord) {
+			class, _ := getAttr(n, "class")
+			setAttrs(n, "class", class, "style", style)
+		}
+		return false
+	})
+}
+
+// decorateImageDiv は classWord と style 属性を持つ div（中身の有無は問わない）の
+// style をサイズ・配置のinlineスタイルで置き換える。既存styleにbackground-imageが
+// あればそれだけ引き継ぐ。style 属性の無い div は変更しない。
+func decorateImageDiv(root *html.Node, classWord, baseStyle string) {
+	walk(root, func(n *html.Node) bool {
+		if n.Type != html.ElementNode || n.DataAtom != atom.Div || !classHas(n, classWord) {
+			return false
+		}
+		style, ok := getAttr(n, "style")
+		if !ok {
+			return false
+		}
+		bg := ""
+		if m := reBgImage.FindString(style); m != "" {
+			bg = m
+			if !strings.HasSuffix(bg, ";") {
+				bg += ";"
+			}
+		}
+		class, _ := getAttr(n, "class")
+		setAttrs(n, "class", class, "style", baseStyle+bg)
+		return false
+	})
+}
+
+// insertAudio は英文直下（最初に見つかった class="dc-line" の div）の
+// 直後に音声用の div を挿入する。
+func insertAudio(root *html.Node, sound string) {
+	s := strings.Trim(sound, `" `)
+	if s == "" {
+		return
+	}
+	if !strings.HasPrefix(s, "[sound:") {
+		if i := strings.Index(s, "[sound:"); i >= 0 {
+			s = s[i:]
+		}
+	}
+
+	var target *html.Node
+	walk(root, func(n *html.Node) bool {
+		if target == nil && n.Type == html.ElementNode && n.DataAtom == atom.Div {
+			if class, ok := getAttr(n, "class"); ok && class == "dc-line" {
+				target = n
+			}
+		}
+		return false
+	})
+	if target == nil || target.Parent == nil {
+		return
+	}
+
+	audio := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	setAttrs(audio, "class", "dc-audio", "style", "padding:0.4rem;margin-top:0.25rem;")
+	audio.AppendChild(&html.Node{Type: html.TextNode, Data: s})
+	target.Parent.InsertBefore(audio, target.NextSibling)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// transform のテーブル駆動テスト。旧正規表現実装がこなしていた基本ケースに加え、
+// マークアップをまたいだ cloze の退行（chunk0-3 レビューで指摘されたもの）を
+// 固定しておく。
+func TestTransform(t *testing.T) {
+	cases := []struct {
+		name         string
+		html         string
+		sound        string
+		wantJa       string
+		wantInOut    []string
+		wantNotInOut []string
+	}{
+		{
+			name:      "plain cloze in single text node",
+			html:      `<div class="dc-line">plain {{c1::word::back}} text</div>`,
+			wantJa:    "back",
+			wantInOut: []string{`<span style="color:red;">word</span>`},
+		},
+		{
+			name:      "cloze split across inline markup",
+			html:      `<div class="dc-line">I like {{c1::<b>foo</b>::bar}} very much.</div>`,
+			wantJa:    "bar",
+			wantInOut: []string{`<span style="color:red;"><b>foo</b></span>`},
+		},
+		{
+			name:         "dc-translation div is extracted and removed",
+			html:         `<div class="dc-line">hello</div><div class="dc-line dc-translation">こんにちは</div>`,
+			wantJa:       "こんにちは",
+			wantInOut:    []string{"hello"},
+			wantNotInOut: []string{"こんにちは", "dc-translation"},
+		},
+		{
+			name:      "dc-down/dc-gap spans are unwrapped",
+			html:      `<div class="dc-line"><span class="dc-down">hidden</span> <span class="dc-gap">rest</span></div>`,
+			wantInOut: []string{"hidden rest"},
+		},
+		{
+			name:         "style tags are stripped",
+			html:         `<style>.x{color:red}</style><div class="dc-line">hi</div>`,
+			wantInOut:    []string{"hi"},
+			wantNotInOut: []string{"<style", ".x{color:red}"},
+		},
+		{
+			name:      "audio is embedded after dc-line",
+			html:      `<div class="dc-line">hi</div>`,
+			sound:     `[sound:clip.mp3]`,
+			wantInOut: []string{`<div class="dc-line">hi</div><div class="dc-audio"`, `[sound:clip.mp3]`},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, ja := transform(tc.html, tc.sound, "red", &defaultRules)
+			if tc.wantJa != "" && ja != tc.wantJa {
+				t.Errorf("ja = %q, want %q", ja, tc.wantJa)
+			}
+			for _, want := range tc.wantInOut {
+				if !strings.Contains(out, want) {
+					t.Errorf("out = %q, want substring %q", out, want)
+				}
+			}
+			for _, unwanted := range tc.wantNotInOut {
+				if strings.Contains(out, unwanted) {
+					t.Errorf("out = %q, must not contain %q", out, unwanted)
+				}
+			}
+		})
+	}
+}
@@ -6,34 +6,13 @@ import (
 	"encoding/csv"
 	"flag"
 	"fmt"
-	"html"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 )
 
-var (
-    reStyleBlock = regexp.MustCompile(`(?is)<style.*?>.*?</style>`)
-    // div直書きの翻訳行（後方互換）
-    reTransDiv   = regexp.MustCompile(`(?is)<div\s+class="dc-line\s+dc-translation[^"]*"\s*>(.*?)</div>`)
-
-    // 場所やタグを問わず、最初に見つかった .dc-translation を拾えるように
-    reAnyTranslation = regexp.MustCompile(`(?is)<[^>]+class="[^"]*\bdc-translation\b[^"]*"[^>]*>(.*?)</[^>]+>`)
-
-    // Cloze の後半もキャプチャする
-    reCloze      = regexp.MustCompile(`(?is)\{\{c\d+::(.*?)(?:::(.*?))?\}\}`)
-
-    reImage      = regexp.MustCompile(`(?is)<div\s+class="([^"]*\bdc-image[^"]*)"\s+style="([^"]*?)"\s*></div>`)
-    reBgImage    = regexp.MustCompile(`(?is)background-image\s*:\s*url\(([^)]+)\)`)
-    reCardDiv    = regexp.MustCompile(`(?is)<div\s+class="([^"]*\bdc-card[^"]*)"(.*?)>`)
-    reUnwrapDown = regexp.MustCompile(`(?is)<span[^>]*class="[^"]*\bdc-down\b[^"]*"[^>]*>(.*?)</span>`)
-    reUnwrapGap  = regexp.MustCompile(`(?is)<span[^>]*class="[^"]*\bdc-gap\b[^"]*"[^>]*>(.*?)</span>`)
-)
-
-
 func main() {
 	// 使い方:
 	//  1) すべてのZIPを差分処理: go run .
@@ -43,6 +22,7 @@ func main() {
 	rawdir := flag.String("rawdir", "data/raw", "directory containing zip files")
 	procdir := flag.String("procdir", "data/processed", "directory to write outputs")
 	color := flag.String("color", "rgb(255, 189, 128)", "color for cloze terms (e.g. #e91e63 or red)")
+	format := flag.String("format", "tsv", "output format for zip input (-in zip, -rawdir batch, -watch): tsv (TSV + collection.media copy) or apkg (standalone .apkg deck); TSV input always writes TSV")
 
 	ankiMedia := flag.String("ankimedia",
 		"/Users/nakaokashinzo/Library/Application Support/Anki2/ユーザー 1/collection.media",
@@ -50,20 +30,54 @@ func main() {
 	overwrite := flag.Bool("overwrite", true, "overwrite media files in Anki media folder")
 	force := flag.Bool("force", false, "reprocess even if output TSV already exists")
 
+	ankiConnect := flag.String("anki-connect", "", "AnkiConnect URL (e.g. http://127.0.0.1:8765) to push notes directly instead of writing TSV/apkg")
+	rulesPath := flag.String("rules", "", "path to JSON rule config for transform() (defaults to built-in rules matching today's DeepL-based cards)")
+	watch := flag.Bool("watch", false, "keep running, polling -rawdir and reprocessing only zips whose item.csv/media content hash changed")
+
+	imgConvert := flag.String("img-convert", "", `external command template to transcode images before copying, e.g. "cwebp -q 80 {in} -o {out}" (empty disables)`)
+	imgConvertExt := flag.String("img-convert-ext", ".webp", "output extension produced by -img-convert")
+	audioConvert := flag.String("audio-convert", "", `external command template to transcode audio before copying, e.g. "ffmpeg -y -i {in} {out}" (empty disables)`)
+	audioConvertExt := flag.String("audio-convert-ext", ".mp3", "output extension produced by -audio-convert")
+
 	flag.Parse()
 
+	rules, err := loadRules(*rulesPath)
+	check(err)
+
+	convert := mediaConvertOpts{
+		ImgCmd:   *imgConvert,
+		ImgExt:   *imgConvertExt,
+		AudioCmd: *audioConvert,
+		AudioExt: *audioConvertExt,
+	}
+
 	check(os.MkdirAll(*procdir, 0o755))
 	check(os.MkdirAll(*ankiMedia, 0o755))
 
 	switch {
+	case *watch:
+		check(runWatch(*rawdir, *procdir, *color, *ankiMedia, *overwrite, *format, rules, convert))
+	case *ankiConnect != "" && *in != "":
+		check(processZipAnkiConnect(*in, *color, *ankiConnect, rules))
+	case *ankiConnect != "":
+		entries, err := os.ReadDir(*rawdir)
+		check(err)
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(strings.ToLower(e.Name()), ".zip") {
+				continue
+			}
+			zipPath := filepath.Join(*rawdir, e.Name())
+			check(processZipAnkiConnect(zipPath, *color, *ankiConnect, rules))
+		}
 	case *in != "":
 		ext := strings.ToLower(filepath.Ext(*in))
-		out := filepath.Join(*procdir, baseNameNoExt(*in)+"_out.tsv")
+		out := outPathFor(*procdir, *in, *format)
 		if ext == ".zip" {
-			check(processZip(*in, out, *color, *ankiMedia, *overwrite))
+			check(processZipWithFormat(*in, out, *color, *ankiMedia, *overwrite, *format, rules, convert))
 			fmt.Printf("OK(zip): %s -> %s\n", *in, out)
 		} else {
-			check(processTSVFile(*in, out, *color))
+			out = outPathFor(*procdir, *in, "tsv")
+			check(processTSVFile(*in, out, *color, rules))
 			fmt.Printf("OK(tsv): %s -> %s\n", *in, out)
 		}
 	default:
@@ -80,14 +94,14 @@ func main() {
 			}
 			foundZip = true
 			zipPath := filepath.Join(*rawdir, e.Name())
-			out := filepath.Join(*procdir, baseNameNoExt(zipPath)+"_out.tsv")
+			out := outPathFor(*procdir, zipPath, *format)
 
 			if !*force && fileExists(out) {
 				fmt.Printf("skip (exists): %s -> %s\n", zipPath, out)
 				continue
 			}
 
-			check(processZip(zipPath, out, *color, *ankiMedia, *overwrite))
+			check(processZipWithFormat(zipPath, out, *color, *ankiMedia, *overwrite, *format, rules, convert))
 			fmt.Printf("OK: %s -> %s\n", zipPath, out)
 		}
 		if !foundZip {
@@ -96,8 +110,24 @@ func main() {
 	}
 }
 
+// outPathFor は -format に応じた出力先パス（*_out.tsv または *.apkg）を決める。
+func outPathFor(procdir, inPath, format string) string {
+	if format == "apkg" {
+		return filepath.Join(procdir, baseNameNoExt(inPath)+".apkg")
+	}
+	return filepath.Join(procdir, baseNameNoExt(inPath)+"_out.tsv")
+}
+
+// processZipWithFormat は -format に応じて TSV+media コピー方式か apkg 方式かを振り分ける。
+func processZipWithFormat(zipPath, outPath, color, ankiMedia string, overwrite bool, format string, rules *Rules, convert mediaConvertOpts) error {
+	if format == "apkg" {
+		return processZipApkg(zipPath, outPath, color, rules)
+	}
+	return processZip(zipPath, outPath, color, ankiMedia, overwrite, rules, convert)
+}
+
 // ----- ZIP を処理：item.csv を変換 + media/ を Anki にコピー -----
-func processZip(zipPath, outPath, color, ankiMedia string, overwrite bool) error {
+func processZip(zipPath, outPath, color, ankiMedia string, overwrite bool, rules *Rules, convert mediaConvertOpts) error {
 	zr, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return err
@@ -108,7 +138,7 @@ func processZip(zipPath, outPath, color, ankiMedia string, overwrite bool) error
 	var fallback *zip.File
 
 	// media コピー
-	copied, skipped, err := copyZipMediaFiles(zr.File, ankiMedia, overwrite)
+	copied, skipped, renames, err := copyZipMediaFiles(zr.File, ankiMedia, overwrite, convert)
 	if err != nil {
 		return fmt.Errorf("copy media from %s: %w", zipPath, err)
 	}
@@ -141,11 +171,41 @@ func processZip(zipPath, outPath, color, ankiMedia string, overwrite bool) error
 	}
 	defer rc.Close()
 
-	return processTSV(rc, outPath, color)
+	return processTSV(rc, outPath, color, rules, renames)
+}
+
+// mediaConvertOpts は -img-convert / -audio-convert 系フラグをまとめたもの。
+// Cmd が空ならそのメディア種別の変換は無効。
+type mediaConvertOpts struct {
+	ImgCmd   string
+	ImgExt   string
+	AudioCmd string
+	AudioExt string
+}
+
+func (o mediaConvertOpts) commandFor(ext string) (cmd, outExt string) {
+	if want, ok := mediaExtMime[ext]; ok {
+		if strings.HasPrefix(want, "image/") && o.ImgCmd != "" {
+			return o.ImgCmd, o.ImgExt
+		}
+		if strings.HasPrefix(want, "audio/") && o.AudioCmd != "" {
+			return o.AudioCmd, o.AudioExt
+		}
+	}
+	return "", ""
 }
 
 // ----- media/ 内のファイルを Anki の collection.media にコピー -----
-func copyZipMediaFiles(files []*zip.File, dest string, overwrite bool) (copied, skipped int, err error) {
+//
+// 拡張子と中身(sniff)が食い違うファイルはリネームまたは拒否し、-img-convert /
+// -audio-convert が設定されていれば外部コマンドで変換し、コンテンツハッシュで
+// 重複ファイルのコピーを避ける。renames は「ZIP内の元ファイル名」→
+// 「実際にコピーされた(最終的な)ファイル名」のマップで、transform() 後の
+// HTML中の参照を書き換えるために使う。
+func copyZipMediaFiles(files []*zip.File, dest string, overwrite bool, convert mediaConvertOpts) (copied, skipped int, renames map[string]string, err error) {
+	renames = make(map[string]string)
+	existing := hashExistingMedia(dest)
+
 	for _, f := range files {
 		name := strings.TrimLeft(f.Name, "/\\")
 		parts := strings.Split(name, "/")
@@ -156,57 +216,97 @@ func copyZipMediaFiles(files []*zip.File, dest string, overwrite bool) (copied,
 		if rel == "" || f.FileInfo().IsDir() {
 			continue
 		}
+		origName := path.Base(rel)
+
+		src, openErr := f.Open()
+		if openErr != nil {
+			return copied, skipped, renames, openErr
+		}
+		data, readErr := io.ReadAll(src)
+		src.Close()
+		if readErr != nil {
+			return copied, skipped, renames, readErr
+		}
+
+		finalName := origName
+		if sniffMismatch(origName, data) {
+			fixed := correctedExt(data)
+			if fixed == "" {
+				fmt.Printf("media: reject %s (extension doesn't match content)\n", origName)
+				continue
+			}
+			finalName = strings.TrimSuffix(origName, filepath.Ext(origName)) + fixed
+		}
+
+		ext := strings.ToLower(filepath.Ext(finalName))
+		if cmd, outExt := convert.commandFor(ext); cmd != "" {
+			tmpIn, tmpErr := os.CreateTemp("", "anki-formater-src-*"+ext)
+			if tmpErr != nil {
+				return copied, skipped, renames, tmpErr
+			}
+			_, writeErr := tmpIn.Write(data)
+			tmpIn.Close()
+			if writeErr != nil {
+				os.Remove(tmpIn.Name())
+				return copied, skipped, renames, writeErr
+			}
+			converted, convErr := transcodeMedia(cmd, tmpIn.Name(), outExt)
+			os.Remove(tmpIn.Name())
+			if convErr != nil {
+				return copied, skipped, renames, convErr
+			}
+			data = converted
+			finalName = strings.TrimSuffix(finalName, filepath.Ext(finalName)) + outExt
+		}
+
+		hash := contentHash(data)
+		if dup, ok := existing[hash]; ok {
+			if dup != origName {
+				renames[origName] = dup
+			}
+			skipped++
+			continue
+		}
 
-		dstPath := filepath.Join(dest, filepath.FromSlash(rel))
+		dstPath := filepath.Join(dest, filepath.FromSlash(finalName))
 		if !overwrite && fileExists(dstPath) {
 			skipped++
 			continue
 		}
 		check(os.MkdirAll(filepath.Dir(dstPath), 0o755))
 
-		src, openErr := f.Open()
-		if openErr != nil {
-			return copied, skipped, openErr
+		tmp := dstPath + ".tmp~"
+		if writeErr := os.WriteFile(tmp, data, 0o644); writeErr != nil {
+			return copied, skipped, renames, writeErr
 		}
-		func() {
-			defer src.Close()
-			tmp := dstPath + ".tmp~"
-			out, createErr := os.Create(tmp)
-			if createErr != nil {
-				err = createErr
-				return
-			}
-			if _, err = io.Copy(out, src); err == nil {
-				err = out.Close()
-			} else {
-				out.Close()
-			}
-			if err == nil {
-				err = os.Rename(tmp, dstPath)
-			} else {
-				_ = os.Remove(tmp)
-			}
-		}()
-		if err != nil {
-			return copied, skipped, err
+		if renameErr := os.Rename(tmp, dstPath); renameErr != nil {
+			_ = os.Remove(tmp)
+			return copied, skipped, renames, renameErr
+		}
+
+		existing[hash] = finalName
+		if finalName != origName {
+			renames[origName] = finalName
 		}
 		copied++
 	}
-	return copied, skipped, nil
+	return copied, skipped, renames, nil
 }
 
 // ----- 単体TSVファイルを処理 -----
-func processTSVFile(inPath, outPath, color string) error {
+func processTSVFile(inPath, outPath, color string, rules *Rules) error {
 	inFile, err := os.Open(inPath)
 	if err != nil {
 		return err
 	}
 	defer inFile.Close()
-	return processTSV(inFile, outPath, color)
+	return processTSV(inFile, outPath, color, rules, nil)
 }
 
 // ----- TSV ストリームを処理 -----
-func processTSV(r io.Reader, outPath, color string) error {
+// renames は copyZipMediaFiles が決めた「元ファイル名→最終ファイル名」の対応表。
+// transform() 後のHTMLに残る旧メディア参照をここで書き換える。
+func processTSV(r io.Reader, outPath, color string, rules *Rules, renames map[string]string) error {
 	br := bufio.NewReader(r)
 	br = stripBOM(br)
 
@@ -242,7 +342,8 @@ func processTSV(r io.Reader, outPath, color string) error {
 			sound = strings.TrimSpace(rec[1])
 		}
 
-		htmlOut, ja := transform(htmlIn, sound, color)
+		htmlOut, ja := transform(htmlIn, sound, color, rules)
+		htmlOut = rewriteMediaRefs(htmlOut, renames)
 		if err := cw.Write([]string{htmlOut, ja}); err != nil {
 			return err
 		}
@@ -251,130 +352,6 @@ func processTSV(r io.Reader, outPath, color string) error {
 	return cw.Error()
 }
 
-func transform(h, sound, color string) (string, string) {
-    // 1) <style>…</style> を削除
-    h = reStyleBlock.ReplaceAllString(h, "")
-
-    // 2) 訳文抽出（優先度：div直書き → どこでも .dc-translation）
-    ja := ""
-    if m := reTransDiv.FindStringSubmatch(h); len(m) >= 2 {
-        ja = strings.TrimSpace(stripTags(m[1]))
-        // 元HTMLからは翻訳行を削除（1カラム目に出したくないため）
-        h = reTransDiv.ReplaceAllString(h, "")
-    }
-    if ja == "" {
-        if m := reAnyTranslation.FindStringSubmatch(h); len(m) >= 2 {
-            ja = strings.TrimSpace(stripTags(m[1]))
-            // Cloze 内でも後で置換されるが、二重表示を避けたいなら明示的に除去しても良い
-            // h = reAnyTranslation.ReplaceAllString(h, "")
-        }
-    }
-
-    // 3) Cloze → 前半のみ色付き化（後半＝訳文は 2) で ja に入れる）
-    h = reCloze.ReplaceAllStringFunc(h, func(s string) string {
-        g := reCloze.FindStringSubmatch(s)
-        front := ""
-        back  := ""
-        if len(g) >= 2 { front = g[1] }
-        if len(g) >= 3 { back  = g[2] }
-
-        // Cloze 後半に訳文があり、まだ ja が空なら採用
-        if ja == "" && strings.TrimSpace(back) != "" {
-            ja = strings.TrimSpace(stripTags(back))
-        }
-
-        // 前半をプレーンテキスト化して色付け
-        plain := strings.TrimSpace(stripTags(front))
-        if plain == "" {
-            return ""
-        }
-        return `<span style="color:` + color + `;">` + html.EscapeString(plain) + `</span>`
-    })
-
-    // 3.5) Cloze外に残る装飾を剥がす
-    for {
-        before := h
-        h = reUnwrapDown.ReplaceAllString(h, "$1")
-        h = reUnwrapGap.ReplaceAllString(h, "$1")
-        if h == before {
-            break
-        }
-    }
-
-    // 4) .dc-card → 下線なしの inline スタイル
-    h = reCardDiv.ReplaceAllString(h, `<div class="$1" style="padding-bottom:1rem;">`)
-
-    // 5) 画像ボックスにサイズ等を inline 付与
-    h = reImage.ReplaceAllStringFunc(h, func(s string) string {
-        p := reImage.FindStringSubmatch(s)
-        if len(p) < 3 {
-            return s
-        }
-        class := p[1]
-        style := p[2]
-
-        bg := ""
-        if m := reBgImage.FindStringSubmatch(style); len(m) >= 2 {
-            bg = m[0]
-            if !strings.HasSuffix(bg, ";") {
-                bg += ";"
-            }
-        }
-        newStyle := strings.Join([]string{
-            "display:inline-block",
-            "width:calc(50% - 10px)",
-            "padding-bottom:29%",
-            "background-position:center",
-            "background-repeat:no-repeat",
-            "background-size:cover",
-            "margin-left:2px",
-            "margin-right:2px",
-        }, ";") + ";"
-        newStyle += bg
-        return `<div class="` + class + `" style="` + newStyle + `"></div>`
-    })
-
-    // 6) 英文直下に音声を差し込み
-    if s := strings.Trim(sound, `" `); s != "" {
-        ss := s
-        if !strings.HasPrefix(ss, "[sound:") {
-            if i := strings.Index(ss, "[sound:"); i >= 0 {
-                ss = ss[i:]
-            }
-        }
-        if idx := strings.Index(h, `<div class="dc-line"`); idx >= 0 {
-            if end := strings.Index(h[idx:], `</div>`); end >= 0 {
-                insert := idx + end + len(`</div>`)
-                audio := `<div class="dc-audio" style="padding:0.4rem;margin-top:0.25rem;">` + ss + `</div>`
-                h = h[:insert] + audio + h[insert:]
-            }
-        }
-    }
-
-    // 軽い整形
-    h = strings.ReplaceAll(h, "  ", " ")
-    return h, ja
-}
-
-
-func stripTags(s string) string {
-	inTag := false
-	var b strings.Builder
-	for _, r := range s {
-		switch r {
-		case '<':
-			inTag = true
-		case '>':
-			inTag = false
-		default:
-			if !inTag {
-				b.WriteRune(r)
-			}
-		}
-	}
-	return strings.TrimSpace(html.UnescapeString(b.String()))
-}
-
 func stripBOM(r *bufio.Reader) *bufio.Reader {
 	if b, _ := r.Peek(3); len(b) == 3 && b[0] == 0xEF && b[1] == 0xBB && b[2] == 0xBF {
 		_, _ = r.Discard(3)
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ----- メディアの MIME 判定・変換まわり -----
+//
+// copyZipMediaFiles は以前、media/ 以下を拡張子も中身も見ずにそのまま
+// collection.media へコピーしていた。ここでは拡張子ごとの想定MIMEテーブルを持ち、
+// 中身との食い違いを検出してリネーム/拒否し、任意で外部コマンドによる変換
+// （画像→webp、音声→mp3/ogg等）をかけ、コンテンツハッシュで重複コピーを防ぐ。
+
+// mediaExtMime は拡張子ごとに期待される MIME タイプ（image/png, audio/mpeg など）。
+var mediaExtMime = map[string]string{
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".webp":  "image/webp",
+	".gif":   "image/gif",
+	".mp3":   "audio/mpeg",
+	".m4a":   "audio/mp4",
+	".ogg":   "audio/ogg",
+	".ttf":   "font/ttf",
+	".woff2": "font/woff2",
+}
+
+// mimeExt は net/http.DetectContentType が返す値から妥当な拡張子への逆引き。
+// 画像は http パッケージのスニッファで十分判定できるが、音声/フォントは
+// application/octet-stream になりがちなので対象外（拡張子側を信用する）。
+var mimeExt = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
+// sniffMismatch は name の拡張子と data の中身(sniffした先頭バイト)が
+// 食い違っていないかを調べる。画像以外（音声・フォント）は sniff 精度が低いため
+// 常に一致扱いにする。
+func sniffMismatch(name string, data []byte) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	want, known := mediaExtMime[ext]
+	if !known || !strings.HasPrefix(want, "image/") {
+		return false
+	}
+	got := http.DetectContentType(data)
+	if i := strings.Index(got, ";"); i >= 0 {
+		got = got[:i]
+	}
+	return got != want
+}
+
+// correctedExt は sniff した中身から妥当な拡張子を返す（わからなければ空文字）。
+func correctedExt(data []byte) string {
+	got := http.DetectContentType(data)
+	if i := strings.Index(got, ";"); i >= 0 {
+		got = got[:i]
+	}
+	return mimeExt[got]
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashExistingMedia は dest に既にあるファイルのコンテンツハッシュを集める。
+// 同じ素材を積んだ複数のZIPを処理しても collection.media が太らないようにするため。
+func hashExistingMedia(dest string) map[string]string {
+	index := make(map[string]string)
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		return index
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dest, e.Name()))
+		if err != nil {
+			continue
+		}
+		index[contentHash(data)] = e.Name()
+	}
+	return index
+}
+
+// transcodeMedia は "cwebp -q 80 {in} -o {out}" のような外部コマンドに
+// 一時ファイル経由で変換させ、結果のバイト列を返す。
+func transcodeMedia(cmdTemplate, srcPath, outExt string) ([]byte, error) {
+	tmp, err := os.CreateTemp("", "anki-formater-*"+outExt)
+	if err != nil {
+		return nil, err
+	}
+	outPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(outPath)
+
+	parts := strings.Fields(cmdTemplate)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("empty conversion command")
+	}
+	for i, p := range parts {
+		p = strings.ReplaceAll(p, "{in}", srcPath)
+		p = strings.ReplaceAll(p, "{out}", outPath)
+		parts[i] = p
+	}
+
+	cmd := exec.Command(parts[0], parts[1:]...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", cmdTemplate, err, out)
+	}
+	return os.ReadFile(outPath)
+}
+
+// rewriteMediaRefs は transform() 後のHTMLに残る旧ファイル名参照
+// （background-image url(...) や [sound:...]）を、リネーム後の名前に置き換える。
+func rewriteMediaRefs(h string, renames map[string]string) string {
+	if len(renames) == 0 {
+		return h
+	}
+	for oldName, newName := range renames {
+		if oldName == newName {
+			continue
+		}
+		h = strings.ReplaceAll(h, oldName, newName)
+	}
+	return h
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Rules は transform() が参照するクラス名・装飾スタイルの外部設定。
+// -rules でJSONファイルを渡さない限り defaultRules（今までの DeepL 向け挙動）が使われる。
+type Rules struct {
+	Translation ruleSelector   `json:"translation"`
+	Unwrap      []ruleSelector `json:"unwrap"`
+	Decorate    []decorateRule `json:"decorate"`
+	Image       imageRule      `json:"image"`
+}
+
+// ruleSelector は今のところ `class~=<word>` 形式（クラス名に <word> を含む）のみ対応する。
+type ruleSelector struct {
+	Selector string `json:"selector"`
+}
+
+type decorateRule struct {
+	Selector string `json:"selector"`
+	Style    string `json:"style"`
+}
+
+type imageRule struct {
+	Selector string `json:"selector"`
+	Style    string `json:"style"`
+}
+
+// defaultRules は今日までハードコードされていた dc-* クラスの挙動そのもの。
+// -rules を指定しないユーザーの出力は変わらない。
+var defaultRules = Rules{
+	Translation: ruleSelector{Selector: "class~=dc-translation"},
+	Unwrap: []ruleSelector{
+		{Selector: "class~=dc-down"},
+		{Selector: "class~=dc-gap"},
+	},
+	Decorate: []decorateRule{
+		{Selector: "class~=dc-card", Style: "padding-bottom:1rem;"},
+	},
+	Image: imageRule{
+		Selector: "class~=dc-image",
+		Style: strings.Join([]string{
+			"display:inline-block",
+			"width:calc(50% - 10px)",
+			"padding-bottom:29%",
+			"background-position:center",
+			"background-repeat:no-repeat",
+			"background-size:cover",
+			"margin-left:2px",
+			"margin-right:2px",
+		}, ";") + ";",
+	},
+}
+
+// loadRules は path が空なら defaultRules を、そうでなければ JSON ファイルから読み込む。
+func loadRules(path string) (*Rules, error) {
+	if path == "" {
+		r := defaultRules
+		return &r, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load rules %s: %w", path, err)
+	}
+	var r Rules
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("parse rules %s: %w", path, err)
+	}
+	return &r, nil
+}
+
+// classWord は "class~=dc-card" のようなセレクタから対象のクラス名を取り出す。
+// 今のところ対応セレクタはこの一種類だけなので、接頭辞以外は無視する。
+func classWord(selector string) string {
+	return strings.TrimPrefix(selector, "class~=")
+}
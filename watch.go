@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ----- -watch: data/raw をポーリングし、変わった ZIP だけ再処理する -----
+
+const watchPollInterval = 5 * time.Second
+
+// rowSnapshot は diff 表示のために state ファイルへ保存する1行分のスナップショット。
+type rowSnapshot struct {
+	HTMLOut string `json:"htmlOut"`
+	Ja      string `json:"ja"`
+}
+
+// watchState は -procdir に残す ZIP ごとのサイドカー (.state.json)。
+type watchState struct {
+	Hash string        `json:"hash"`
+	Rows []rowSnapshot `json:"rows"`
+}
+
+// runWatch は -rawdir を poll し続け、内容が変わった ZIP のみ再処理する。
+func runWatch(rawdir, procdir, color, ankiMedia string, overwrite bool, format string, rules *Rules, convert mediaConvertOpts) error {
+	fmt.Printf("watch: polling %s every %s (Ctrl+C to stop)\n", rawdir, watchPollInterval)
+	for {
+		entries, err := os.ReadDir(rawdir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(strings.ToLower(e.Name()), ".zip") {
+				continue
+			}
+			zipPath := filepath.Join(rawdir, e.Name())
+			if err := watchProcessOne(zipPath, procdir, color, ankiMedia, overwrite, format, rules, convert); err != nil {
+				fmt.Printf("watch: %s: %v\n", zipPath, err)
+			}
+		}
+		time.Sleep(watchPollInterval)
+	}
+}
+
+// watchProcessOne はハッシュが前回と異なる場合のみ再処理し、行単位の差分件数を表示する。
+func watchProcessOne(zipPath, procdir, color, ankiMedia string, overwrite bool, format string, rules *Rules, convert mediaConvertOpts) error {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	itemFile, mediaFiles := selectItemAndMedia(zr.File)
+	if itemFile == nil {
+		return fmt.Errorf("item.csv not found in %s", zipPath)
+	}
+
+	hash, err := zipContentHash(itemFile, mediaFiles)
+	if err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(procdir, baseNameNoExt(zipPath)+".state.json")
+	prev := loadWatchState(statePath)
+	if prev != nil && prev.Hash == hash {
+		return nil
+	}
+
+	rc, err := itemFile.Open()
+	if err != nil {
+		return err
+	}
+	rows, err := readNoteRows(rc, color, rules)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	out := outPathFor(procdir, zipPath, format)
+	if err := processZipWithFormat(zipPath, out, color, ankiMedia, overwrite, format, rules, convert); err != nil {
+		return err
+	}
+
+	added, changed, removed := diffRows(prev, rows)
+	if prev == nil {
+		fmt.Printf("watch: %s -> %s (new, %d rows)\n", zipPath, out, len(rows))
+	} else {
+		fmt.Printf("watch: %s -> %s (+%d ~%d -%d)\n", zipPath, out, added, changed, removed)
+	}
+
+	return saveWatchState(statePath, hash, rows)
+}
+
+// selectItemAndMedia は processZip 系関数と同じ基準で item.csv と media/ 以下を拾う。
+func selectItemAndMedia(files []*zip.File) (*zip.File, []*zip.File) {
+	var target, fallback *zip.File
+	var mediaFiles []*zip.File
+	for _, f := range files {
+		base := strings.ToLower(path.Base(f.Name))
+		switch base {
+		case "item.csv", "items.csv":
+			target = f
+		default:
+			if strings.HasSuffix(base, ".csv") && fallback == nil {
+				fallback = f
+			}
+		}
+		name := strings.TrimLeft(f.Name, "/\\")
+		parts := strings.Split(name, "/")
+		if len(parts) >= 2 && strings.EqualFold(parts[0], "media") && !f.FileInfo().IsDir() {
+			mediaFiles = append(mediaFiles, f)
+		}
+	}
+	if target == nil {
+		target = fallback
+	}
+	return target, mediaFiles
+}
+
+// zipContentHash は item.csv の内容と media/ 以下の (名前, CRC) 集合から決定的なハッシュを作る。
+func zipContentHash(itemFile *zip.File, mediaFiles []*zip.File) (string, error) {
+	h := sha256.New()
+
+	rc, err := itemFile.Open()
+	if err != nil {
+		return "", err
+	}
+	if _, err := h.Write([]byte(itemFile.Name)); err != nil {
+		rc.Close()
+		return "", err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := rc.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	rc.Close()
+
+	names := make([]string, len(mediaFiles))
+	crc := make(map[string]uint32, len(mediaFiles))
+	for i, f := range mediaFiles {
+		names[i] = f.Name
+		crc[f.Name] = f.CRC32
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s:%08x\n", name, crc[name])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func loadWatchState(path string) *watchState {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var st watchState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil
+	}
+	return &st
+}
+
+func saveWatchState(path, hash string, rows []noteRow) error {
+	st := watchState{Hash: hash, Rows: make([]rowSnapshot, len(rows))}
+	for i, r := range rows {
+		st.Rows[i] = rowSnapshot{HTMLOut: r.front, Ja: r.back}
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// diffRows は同じ行インデックスで前回スナップショットと突き合わせ、
+// 追加・変更・削除の件数を数える。
+func diffRows(prev *watchState, rows []noteRow) (added, changed, removed int) {
+	oldLen := 0
+	if prev != nil {
+		oldLen = len(prev.Rows)
+	}
+	newLen := len(rows)
+
+	max := oldLen
+	if newLen > max {
+		max = newLen
+	}
+	for i := 0; i < max; i++ {
+		switch {
+		case i >= oldLen:
+			added++
+		case i >= newLen:
+			removed++
+		default:
+			if prev.Rows[i].HTMLOut != rows[i].front || prev.Rows[i].Ja != rows[i].back {
+				changed++
+			}
+		}
+	}
+	return
+}